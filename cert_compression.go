@@ -1,14 +1,11 @@
 package tls
 
 import (
-	"bytes"
-	"compress/zlib"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"time"
 
-	"github.com/andybalholm/brotli"
 	"golang.org/x/crypto/cryptobyte"
 )
 
@@ -17,6 +14,26 @@ import (
 const (
 	certCompressionAlgs    uint16 = 27
 	typeCertAlgCompression uint8  = 25
+
+	// maxDecompressedCertSize is an absolute ceiling on decompressed
+	// certificate size that no Config.MaxCertificateDecompressedSize value
+	// can exceed, regardless of what the peer advertised in
+	// uncompressedLength, guarding against a peer lying about the size and
+	// forcing us to inflate an unbounded amount of data (a decompression
+	// bomb).
+	maxDecompressedCertSize = 1 << 24
+
+	// DefaultMaxCertificateDecompressedSize is used for
+	// Config.MaxCertificateDecompressedSize when it is zero. A leaf
+	// certificate chain is normally a few KiB, so 64 KiB leaves headroom for
+	// longer chains while keeping a compression bomb's amplification
+	// bounded.
+	DefaultMaxCertificateDecompressedSize = 64 * 1024
+
+	// maxCertCompressionMethods is the most CertCompressionAlgo entries that
+	// can be advertised: RFC 8879's algorithms list is prefixed by a single
+	// byte of length in bytes, and each entry is 2 bytes wide.
+	maxCertCompressionMethods = 255 / 2
 )
 
 type CertAlgCompressionExtension struct {
@@ -36,26 +53,31 @@ func (e *CertAlgCompressionExtension) Read(b []byte) (int, error) {
 	if len(b) < e.Len() {
 		return 0, io.ErrShortBuffer
 	}
-	// https://tools.ietf.org/html/draft-balfanz-tls-channelid-00
-	b[0] = byte(certCompressionAlgs >> 8)
-	b[1] = byte(certCompressionAlgs & 0xff)
-
-	extLen := 2 * len(e.Methods)
-	if extLen > 255 {
+	if len(e.Methods) > maxCertCompressionMethods {
 		return 0, errors.New("too many certificate compression methods")
 	}
 
-	b[2] = byte((extLen + 1) >> 8)
-	b[3] = byte((extLen + 1) & 0xff)
-	b[4] = byte(extLen)
-
-	i := 5
-	for _, compMethod := range e.Methods {
-		b[i] = byte(compMethod >> 8)
-		b[i+1] = byte(compMethod)
-		i += 2
+	// Per RFC 8879, the extension_data is a u8 algorithms-length followed
+	// by that many bytes of u16 algorithm IDs; that whole blob is in turn
+	// prefixed by the usual u16 extension-data length used for every TLS
+	// extension. Building it with cryptobyte, rather than hand-computing
+	// each length field, keeps the outer (2-byte) and inner (1-byte)
+	// lengths from being conflated.
+	var out cryptobyte.Builder
+	out.AddUint16(certCompressionAlgs)
+	out.AddUint16LengthPrefixed(func(ext *cryptobyte.Builder) {
+		ext.AddUint8LengthPrefixed(func(algs *cryptobyte.Builder) {
+			for _, compMethod := range e.Methods {
+				algs.AddUint16(uint16(compMethod))
+			}
+		})
+	})
+
+	data, err := out.Bytes()
+	if err != nil {
+		return 0, err
 	}
-	return e.Len(), io.EOF
+	return copy(b, data), io.EOF
 }
 
 type certAlgCompressionMessage struct {
@@ -70,10 +92,111 @@ func (m *certAlgCompressionMessage) marshal() []byte {
 		return m.data
 	}
 
-	return []byte{} //TODO: implement it
+	// Emit a full CompressedCertificate handshake message: the 4-byte
+	// handshake header (typeCertAlgCompression + u24 length) followed by
+	// algorithm || uncompressed_length(24) || compressed_certificate_message
+	// (24-bit length prefixed), matching what unmarshal expects to find at
+	// data[4:].
+	var body cryptobyte.Builder
+	body.AddUint16(uint16(m.method))
+	body.AddUint24(m.uncompressedLength)
+	body.AddUint24LengthPrefixed(func(c *cryptobyte.Builder) {
+		c.AddBytes(m.compressedCertificateMessage)
+	})
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeCertAlgCompression)
+	b.AddUint24LengthPrefixed(func(c *cryptobyte.Builder) {
+		c.AddBytes(body.BytesOrPanic())
+	})
+
+	m.data = b.BytesOrPanic()
+	return m.data
+}
+
+// newCertAlgCompressionMessage compresses certMsg (the marshaled
+// CertificateMsgTLS13, including its 4-byte handshake header) with algo and
+// returns the resulting compressed_certificate message, ready to be sent in
+// place of a plain Certificate message. Its caller in this package is
+// compressClientCertificateMsg.
+func newCertAlgCompressionMessage(algo CertCompressionAlgo, certMsg []byte) (*certAlgCompressionMessage, error) {
+	// certMsg carries the 4-byte handshake message header (type + u24
+	// length); only the body is compressed, matching what toCertificateMsg
+	// strips back off on the decompression path.
+	if len(certMsg) < 4 {
+		return nil, errors.New("certificate message is too short to compress")
+	}
+	body := certMsg[4:]
+
+	compressed, err := compressCertBody(algo, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certAlgCompressionMessage{
+		method:                       algo,
+		uncompressedLength:           uint32(len(body)),
+		compressedCertificateMessage: compressed,
+	}, nil
+}
+
+func compressCertBody(algo CertCompressionAlgo, body []byte) ([]byte, error) {
+	c, ok := getCertCompressor(algo)
+	if !ok {
+		return nil, fmt.Errorf("certificate compression method %v is not supported", algo)
+	}
+	return c.Compress(nil, body)
+}
+
+// compressClientCertificateMsg builds a compressed Certificate message to
+// send in response to a CertificateRequest: serverAlgos is read off the
+// CertificateRequest's compress_certificate extension, and certMsg is the
+// already-marshaled CertificateMsgTLS13 the client would otherwise send
+// uncompressed. It returns ok == false when uc is not configured with any
+// algorithm the server advertised, in which case the caller must send
+// certMsg as-is.
+//
+// TODO(chunk0-2): this is not yet called from the TLS 1.3 client's
+// CertificateRequest handling — that handshake state machine file is not
+// part of this tree, so no client currently sends a compressed Certificate
+// on a real connection. Wire a call to this in on CertificateRequest receipt
+// once that file is available.
+func (uc *UConn) compressClientCertificateMsg(serverAlgos []CertCompressionAlgo, certMsg []byte) (compressed []byte, ok bool, err error) {
+	algo, ok := selectCertCompressionAlgo(serverAlgos, uc.config.CertCompressionAlgos)
+	if !ok {
+		return nil, false, nil
+	}
+
+	m, err := newCertAlgCompressionMessage(algo, certMsg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return m.marshal(), true, nil
+}
+
+// selectCertCompressionAlgo picks the certificate compression algorithm to
+// use for an outgoing client Certificate message, given the algorithms the
+// server advertised in a CertificateRequest's compress_certificate extension
+// and the ones this client is configured to send. It returns ok == false if
+// there is no overlap, in which case the caller should fall back to sending
+// an uncompressed Certificate message.
+func selectCertCompressionAlgo(serverAlgos, clientAlgos []CertCompressionAlgo) (algo CertCompressionAlgo, ok bool) {
+	for _, want := range clientAlgos {
+		for _, have := range serverAlgos {
+			if want == have {
+				return want, true
+			}
+		}
+	}
+	return 0, false
 }
 
 func (m *certAlgCompressionMessage) unmarshal(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+
 	m.data = append([]byte{}, data...)
 
 	s := cryptobyte.String(data[4:])
@@ -94,40 +217,34 @@ func (m *certAlgCompressionMessage) unmarshal(data []byte) bool {
 	return true
 }
 
-func (m *certAlgCompressionMessage) toCertificateMsg() (*CertificateMsgTLS13, error) {
+// toCertificateMsg decompresses m into a CertificateMsgTLS13, rejecting
+// anything that decompresses to more than maxSize bytes. maxSize should
+// normally be Config.MaxCertificateDecompressedSize; a value of zero falls
+// back to DefaultMaxCertificateDecompressedSize, and any value above
+// maxDecompressedCertSize is clamped to it.
+func (m *certAlgCompressionMessage) toCertificateMsg(maxSize uint32) (*CertificateMsgTLS13, error) {
 	var (
 		decompressed []byte
-		r            io.ReadCloser
 		err          error
 	)
 
-	if m.uncompressedLength > 1<<24 {
-		return nil, fmt.Errorf("decompressed certificate is to large")
+	if maxSize == 0 {
+		maxSize = DefaultMaxCertificateDecompressedSize
+	}
+	if maxSize > maxDecompressedCertSize {
+		maxSize = maxDecompressedCertSize
 	}
 
-	compressed := bytes.NewBuffer(m.compressedCertificateMessage)
-	decompressed = make([]byte, m.uncompressedLength)
-
-	switch m.method {
-	case CertCompressionZlib:
-		r, err = zlib.NewReader(compressed)
-		if err != nil {
-			decompressed, err = ioutil.ReadAll(r)
-		}
-
-		if err != nil {
-			r.Close()
-		}
-
-	case CertCompressionBrotli:
-		decompressed, err = ioutil.ReadAll(brotli.NewReader(compressed))
-
-	//TODO:Implement zstd decompression
+	if m.uncompressedLength > maxSize {
+		return nil, fmt.Errorf("decompressed certificate is to large")
+	}
 
-	default:
+	c, ok := getCertCompressor(m.method)
+	if !ok {
 		return nil, fmt.Errorf("certificate compression method %v is not supported", m.method)
 	}
 
+	decompressed, err = c.Decompress(nil, m.compressedCertificateMessage, int64(maxSize))
 	if err != nil {
 		return nil, err
 	}
@@ -151,3 +268,79 @@ func (m *certAlgCompressionMessage) toCertificateMsg() (*CertificateMsgTLS13, er
 
 	return &mm, nil
 }
+
+// CertCompressionInfo reports the outcome of negotiating and decompressing a
+// server's compressed_certificate message, for telemetry and fingerprinting
+// purposes. decompressServerCertificateMsg stores it in the unexported
+// UConn.certCompressionInfo field; no exported accessor returns it.
+type CertCompressionInfo struct {
+	Algo             CertCompressionAlgo
+	CompressedSize   int
+	UncompressedSize int
+	DecompressTime   time.Duration
+}
+
+// CertCompressionCallback is invoked by decompressServerCertificateMsg with
+// the negotiated algorithm and message sizes of a parsed
+// compressed_certificate message, before its payload is decompressed. It lets
+// callers veto a negotiated compression based on connection context, e.g.
+// refusing zstd from certain SNIs, or enforcing a compression-ratio bound to
+// mitigate zip-bomb-style attacks. A non-nil error is returned from
+// decompressServerCertificateMsg and the payload is not decompressed.
+type CertCompressionCallback func(info CertCompressionInfo) error
+
+// decompressServerCertificateMsg turns a received compressed_certificate
+// message into a CertificateMsgTLS13. It records the outcome on
+// uc.certCompressionInfo unconditionally (including on error, so
+// failed/vetoed negotiations are still observable), and invokes
+// uc.config.CertCompressionCallback, if set, before decompressing so it can
+// veto the negotiated algorithm.
+//
+// TODO(chunk0-5): this is not yet called from the TLS 1.3 client's
+// Certificate-message receive path — that handshake state machine file is
+// not part of this tree, so uc.certCompressionInfo is never populated and
+// CertCompressionCallback is never invoked on a real connection. Wire a call
+// to this in wherever the client currently parses an incoming (possibly
+// compressed) Certificate message, once that file is available.
+func (uc *UConn) decompressServerCertificateMsg(m *certAlgCompressionMessage) (*CertificateMsgTLS13, error) {
+	info := CertCompressionInfo{
+		Algo:             m.method,
+		CompressedSize:   len(m.compressedCertificateMessage),
+		UncompressedSize: int(m.uncompressedLength),
+	}
+
+	if cb := uc.config.CertCompressionCallback; cb != nil {
+		if err := cb(info); err != nil {
+			uc.certCompressionInfo = info
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	msg, err := m.toCertificateMsg(uc.config.MaxCertificateDecompressedSize)
+	info.DecompressTime = time.Since(start)
+	uc.certCompressionInfo = info
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// readAllCapped reads r to completion, returning an error if more than limit
+// bytes would be produced. It exists so decompression of a certificate
+// compression payload can never be tricked into inflating an unbounded
+// amount of data by a peer that sends a small compressed blob with a huge
+// compression ratio (a decompression bomb), independent of whatever
+// uncompressedLength the peer advertised.
+func readAllCapped(r io.Reader, limit int64) ([]byte, error) {
+	limited := io.LimitReader(r, limit+1)
+	data, err := io.ReadAll(limited)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("decompressed certificate exceeds maximum allowed size of %d bytes", limit)
+	}
+	return data, nil
+}
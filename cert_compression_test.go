@@ -0,0 +1,296 @@
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// FuzzCertAlgCompressionExtensionRead exercises the RFC 8879 wire-format
+// encoding directly: for any list of methods within the allowed range, Read
+// must produce an algorithms-list whose outer and inner length fields agree
+// with what was actually written, and must never panic or write out of
+// bounds.
+func FuzzCertAlgCompressionExtensionRead(f *testing.F) {
+	f.Add([]byte{0x00, 0x01, 0x00, 0x02})
+	f.Add([]byte{})
+	f.Add(make([]byte, 2*(maxCertCompressionMethods+5)))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		methods := make([]CertCompressionAlgo, len(raw)/2)
+		for i := range methods {
+			methods[i] = CertCompressionAlgo(uint16(raw[2*i])<<8 | uint16(raw[2*i+1]))
+		}
+		e := &CertAlgCompressionExtension{Methods: methods}
+
+		b := make([]byte, e.Len())
+		n, err := e.Read(b)
+		if len(methods) > maxCertCompressionMethods {
+			if err == nil {
+				t.Fatalf("Read succeeded with %d methods, want error", len(methods))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Read failed for %d methods: %v", len(methods), err)
+		}
+		if n != e.Len() {
+			t.Fatalf("Read returned %d bytes, want %d", n, e.Len())
+		}
+
+		s := cryptobyte.String(b)
+		var extType uint16
+		var extData cryptobyte.String
+		if !s.ReadUint16(&extType) || extType != certCompressionAlgs {
+			t.Fatalf("unexpected extension type")
+		}
+		if !s.ReadUint16LengthPrefixed(&extData) || !s.Empty() {
+			t.Fatalf("outer length prefix does not match written data")
+		}
+		var algs cryptobyte.String
+		if !extData.ReadUint8LengthPrefixed(&algs) || !extData.Empty() {
+			t.Fatalf("inner algorithms-length prefix does not match written data")
+		}
+		if len(algs)%2 != 0 {
+			t.Fatalf("algorithms list is not a whole number of uint16s")
+		}
+		if len(algs)/2 != len(methods) {
+			t.Fatalf("got %d algorithms, want %d", len(algs)/2, len(methods))
+		}
+	})
+}
+
+// FuzzCertAlgCompressionMessageUnmarshal feeds arbitrary attacker-controlled
+// bytes into unmarshal, which parses a compressed_certificate handshake
+// message straight off the wire. It must never panic, regardless of input.
+// The last four seeds are the malformed-message scenarios asserted in detail by
+// TestCertAlgCompressionMessageUnmarshalMalformedInput.
+func FuzzCertAlgCompressionMessageUnmarshal(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0, 0, 0, 0, 0, 2, 0, 0, 0, 3, 1, 2, 3})
+	f.Add(truncatedCertAlgCompressionMsg())
+	f.Add(oversizedUncompressedLengthCertAlgCompressionMsg())
+	f.Add(zeroAlgorithmCertAlgCompressionMsg())
+	f.Add(mismatchedInnerLengthCertAlgCompressionMsg())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m certAlgCompressionMessage
+		m.unmarshal(data)
+	})
+}
+
+// buildCertAlgCompressionMsg assembles a well-formed compressed_certificate
+// handshake message with the given fields, for tests that need to corrupt
+// one specific part of an otherwise-valid message.
+func buildCertAlgCompressionMsg(algID uint16, uncompressedLength uint32, compressed []byte) []byte {
+	var body cryptobyte.Builder
+	body.AddUint16(algID)
+	body.AddUint24(uncompressedLength)
+	body.AddUint24LengthPrefixed(func(c *cryptobyte.Builder) {
+		c.AddBytes(compressed)
+	})
+
+	var b cryptobyte.Builder
+	b.AddUint8(typeCertAlgCompression)
+	b.AddUint24LengthPrefixed(func(c *cryptobyte.Builder) {
+		c.AddBytes(body.BytesOrPanic())
+	})
+	return b.BytesOrPanic()
+}
+
+// truncatedCertAlgCompressionMsg is cut off partway through the
+// compressed_certificate_message field.
+func truncatedCertAlgCompressionMsg() []byte {
+	full := buildCertAlgCompressionMsg(uint16(CertCompressionZlib), 3, []byte{1, 2, 3})
+	return full[:len(full)-2]
+}
+
+// oversizedUncompressedLengthCertAlgCompressionMsg is otherwise well-formed
+// but claims a decompressed size far larger than the compressed payload it
+// carries, the shape a decompression-bomb attempt would take on the wire.
+func oversizedUncompressedLengthCertAlgCompressionMsg() []byte {
+	return buildCertAlgCompressionMsg(uint16(CertCompressionZlib), 1<<24-1, []byte{1, 2, 3})
+}
+
+// zeroAlgorithmCertAlgCompressionMsg advertises algorithm 0, which none of
+// the built-in CertCompressors is registered for.
+func zeroAlgorithmCertAlgCompressionMsg() []byte {
+	return buildCertAlgCompressionMsg(0, 3, []byte{1, 2, 3})
+}
+
+// mismatchedInnerLengthCertAlgCompressionMsg has an inner u24 length prefix
+// (on compressed_certificate_message) that claims more bytes than the
+// message actually contains.
+func mismatchedInnerLengthCertAlgCompressionMsg() []byte {
+	full := buildCertAlgCompressionMsg(uint16(CertCompressionZlib), 3, []byte{1, 2, 3})
+	// The inner u24 length prefix starts right after algID(2) + header(4) +
+	// uncompressedLength(3) = 9 bytes in; bump it past the actual remaining
+	// data without extending the message.
+	full[9] += 0x10
+	return full
+}
+
+// TestCertAlgCompressionMessageUnmarshalMalformedInput asserts concrete
+// behavior for the malformed-message scenarios a peer lying on the wire
+// could produce, rather than only checking that unmarshal doesn't panic.
+func TestCertAlgCompressionMessageUnmarshalMalformedInput(t *testing.T) {
+	t.Run("truncated", func(t *testing.T) {
+		var m certAlgCompressionMessage
+		if m.unmarshal(truncatedCertAlgCompressionMsg()) {
+			t.Fatalf("unmarshal accepted a truncated message")
+		}
+	})
+
+	t.Run("oversized uncompressedLength", func(t *testing.T) {
+		var m certAlgCompressionMessage
+		if !m.unmarshal(oversizedUncompressedLengthCertAlgCompressionMsg()) {
+			t.Fatalf("unmarshal rejected a structurally valid message")
+		}
+		if m.uncompressedLength != 1<<24-1 {
+			t.Fatalf("got uncompressedLength %d, want %d", m.uncompressedLength, 1<<24-1)
+		}
+		// unmarshal only parses the wire format; the bomb guard lives in
+		// toCertificateMsg, which must reject this against a small cap.
+		if _, err := m.toCertificateMsg(128); err == nil {
+			t.Fatalf("toCertificateMsg accepted uncompressedLength exceeding maxSize")
+		}
+	})
+
+	t.Run("algorithm=0", func(t *testing.T) {
+		var m certAlgCompressionMessage
+		if !m.unmarshal(zeroAlgorithmCertAlgCompressionMsg()) {
+			t.Fatalf("unmarshal rejected a structurally valid message")
+		}
+		if m.method != 0 {
+			t.Fatalf("got method %v, want 0", m.method)
+		}
+		if _, err := m.toCertificateMsg(0); err == nil {
+			t.Fatalf("toCertificateMsg accepted an unregistered algorithm 0")
+		}
+	})
+
+	t.Run("mismatched inner length", func(t *testing.T) {
+		var m certAlgCompressionMessage
+		if m.unmarshal(mismatchedInnerLengthCertAlgCompressionMsg()) {
+			t.Fatalf("unmarshal accepted a message whose inner length prefix overruns the data")
+		}
+	})
+}
+
+func TestNewCertAlgCompressionMessageMarshalUnmarshalRoundTrips(t *testing.T) {
+	// handshake header + 4-byte body: empty certificate_request_context and
+	// empty certificate_list, so the decompressed body parses as a Certificate.
+	certMsg := []byte{11, 0, 0, 4, 0, 0, 0, 0}
+
+	m, err := newCertAlgCompressionMessage(CertCompressionZlib, certMsg)
+	if err != nil {
+		t.Fatalf("newCertAlgCompressionMessage failed: %v", err)
+	}
+
+	wire := m.marshal()
+	if wire[0] != typeCertAlgCompression {
+		t.Fatalf("got handshake message type %d, want %d", wire[0], typeCertAlgCompression)
+	}
+	wantLen := len(wire) - 4
+	gotLen := int(wire[1])<<16 | int(wire[2])<<8 | int(wire[3])
+	if gotLen != wantLen {
+		t.Fatalf("handshake header length %d does not match body length %d", gotLen, wantLen)
+	}
+
+	var parsed certAlgCompressionMessage
+	if !parsed.unmarshal(wire) {
+		t.Fatalf("unmarshal rejected marshal's own output")
+	}
+	if parsed.method != CertCompressionZlib {
+		t.Fatalf("got method %v, want %v", parsed.method, CertCompressionZlib)
+	}
+	if parsed.uncompressedLength != 4 {
+		t.Fatalf("got uncompressedLength %d, want 4", parsed.uncompressedLength)
+	}
+
+	got, err := parsed.toCertificateMsg(0)
+	if err != nil {
+		t.Fatalf("toCertificateMsg failed: %v", err)
+	}
+	_ = got
+}
+
+func TestSelectCertCompressionAlgoPrefersClientOrder(t *testing.T) {
+	algo, ok := selectCertCompressionAlgo(
+		[]CertCompressionAlgo{CertCompressionBrotli, CertCompressionZlib},
+		[]CertCompressionAlgo{CertCompressionZlib, CertCompressionBrotli},
+	)
+	if !ok || algo != CertCompressionZlib {
+		t.Fatalf("got (%v, %v), want (%v, true)", algo, ok, CertCompressionZlib)
+	}
+
+	if _, ok := selectCertCompressionAlgo(
+		[]CertCompressionAlgo{CertCompressionBrotli},
+		[]CertCompressionAlgo{CertCompressionZlib},
+	); ok {
+		t.Fatalf("expected no overlap to report ok == false")
+	}
+}
+
+// TestZlibCertCompressorDecompressHonorsMaxSize guards against a server
+// advertising a small uncompressedLength while shipping a compressed blob
+// that actually inflates far past it: Decompress must return an error once
+// the output exceeds maxSize bytes, rather than fully inflating the payload
+// before a caller checks the result length.
+func TestZlibCertCompressorDecompressHonorsMaxSize(t *testing.T) {
+	large := bytes.Repeat([]byte{0}, 8192)
+	compressed, err := (zlibCertCompressor{}).Compress(nil, large)
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+
+	if _, err := (zlibCertCompressor{}).Decompress(nil, compressed, 128); err == nil {
+		t.Fatalf("Decompress succeeded past the 128-byte maxSize")
+	}
+
+	got, err := (zlibCertCompressor{}).Decompress(nil, compressed, int64(len(large)))
+	if err != nil {
+		t.Fatalf("Decompress failed within maxSize: %v", err)
+	}
+	if !bytes.Equal(got, large) {
+		t.Fatalf("decompressed output does not match original")
+	}
+}
+
+func TestDecompressServerCertificateMsgReportsInfoAndHonorsVeto(t *testing.T) {
+	m := &certAlgCompressionMessage{
+		method:             CertCompressionZlib,
+		uncompressedLength: 3,
+	}
+	compressed, err := compressCertBody(CertCompressionZlib, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatalf("compressCertBody failed: %v", err)
+	}
+	m.compressedCertificateMessage = compressed
+
+	var gotInfo CertCompressionInfo
+	vetoErr := errors.New("rejected by policy")
+	uc := &UConn{config: &Config{
+		CertCompressionCallback: func(info CertCompressionInfo) error {
+			gotInfo = info
+			return vetoErr
+		},
+	}}
+
+	_, err = uc.decompressServerCertificateMsg(m)
+	if err != vetoErr {
+		t.Fatalf("got err %v, want %v", err, vetoErr)
+	}
+	if gotInfo.Algo != CertCompressionZlib {
+		t.Fatalf("got algo %v, want %v", gotInfo.Algo, CertCompressionZlib)
+	}
+	if gotInfo.CompressedSize != len(compressed) || gotInfo.UncompressedSize != 3 {
+		t.Fatalf("unexpected sizes in callback info: %+v", gotInfo)
+	}
+	if uc.certCompressionInfo != gotInfo {
+		t.Fatalf("uc.certCompressionInfo %+v does not match what the callback observed %+v", uc.certCompressionInfo, gotInfo)
+	}
+}
@@ -0,0 +1,163 @@
+package tls
+
+import (
+	"bytes"
+	"compress/zlib"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CertCompressor implements a single certificate compression algorithm for
+// use with the compress_certificate extension (RFC 8879). Register a custom
+// implementation with RegisterCertCompressor to support an algorithm beyond
+// the zlib, brotli, and zstd codecs uTLS ships with out of the box, or to
+// replace one of them (e.g. with a dictionary-trained codec).
+//
+// Compress and Decompress follow the append convention used elsewhere in the
+// standard library: the result is appended to dst, which may be nil.
+//
+// Decompress must stop reading and return an error once it has produced more
+// than maxSize bytes, rather than inflating the input fully and checking the
+// result length afterward — src is attacker-controlled and may be a small
+// blob engineered to expand far past maxSize.
+type CertCompressor interface {
+	Compress(dst, src []byte) ([]byte, error)
+	Decompress(dst, src []byte, maxSize int64) ([]byte, error)
+	Algorithm() CertCompressionAlgo
+}
+
+var (
+	certCompressorsMu sync.RWMutex
+	certCompressors   = map[CertCompressionAlgo]CertCompressor{}
+)
+
+// RegisterCertCompressor registers c as the implementation used for algo,
+// replacing any previously registered implementation for that algorithm,
+// including uTLS's built-in zlib, brotli, and zstd codecs. It is typically
+// called from an init function before any connection that negotiates algo
+// is made.
+func RegisterCertCompressor(algo CertCompressionAlgo, c CertCompressor) {
+	certCompressorsMu.Lock()
+	defer certCompressorsMu.Unlock()
+	certCompressors[algo] = c
+}
+
+func getCertCompressor(algo CertCompressionAlgo) (CertCompressor, bool) {
+	certCompressorsMu.RLock()
+	defer certCompressorsMu.RUnlock()
+	c, ok := certCompressors[algo]
+	return c, ok
+}
+
+func init() {
+	RegisterCertCompressor(CertCompressionZlib, zlibCertCompressor{})
+	RegisterCertCompressor(CertCompressionBrotli, brotliCertCompressor{})
+	RegisterCertCompressor(CertCompressionZstd, zstdCertCompressor{})
+}
+
+type zlibCertCompressor struct{}
+
+func (zlibCertCompressor) Algorithm() CertCompressionAlgo { return CertCompressionZlib }
+
+func (zlibCertCompressor) Compress(dst, src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return append(dst, buf.Bytes()...), nil
+}
+
+func (zlibCertCompressor) Decompress(dst, src []byte, maxSize int64) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	decompressed, err := readAllCapped(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, decompressed...), nil
+}
+
+type brotliCertCompressor struct{}
+
+func (brotliCertCompressor) Algorithm() CertCompressionAlgo { return CertCompressionBrotli }
+
+func (brotliCertCompressor) Compress(dst, src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return append(dst, buf.Bytes()...), nil
+}
+
+func (brotliCertCompressor) Decompress(dst, src []byte, maxSize int64) ([]byte, error) {
+	decompressed, err := readAllCapped(brotli.NewReader(bytes.NewReader(src)), maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, decompressed...), nil
+}
+
+// zstdEncoder is shared across all calls: klauspost/compress/zstd documents
+// EncodeAll as safe for concurrent use on a single Encoder, so one
+// long-lived encoder avoids paying its setup cost (which spins up internal
+// goroutines) on every Compress call.
+var zstdEncoder = func() *zstd.Encoder {
+	e, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic("tls: failed to initialize zstd encoder: " + err.Error())
+	}
+	return e
+}()
+
+// zstdDecoderPool holds reusable streaming *zstd.Decoders. Unlike the
+// encoder, decompression of attacker-controlled input must stay streaming
+// (so readAllCapped can enforce the caller's maxSize), and a single
+// streaming Decoder cannot be driven by multiple goroutines at once, so
+// decoders are pooled rather than shared.
+var zstdDecoderPool = sync.Pool{
+	New: func() interface{} {
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			panic("tls: failed to initialize zstd decoder: " + err.Error())
+		}
+		return d
+	},
+}
+
+type zstdCertCompressor struct{}
+
+func (zstdCertCompressor) Algorithm() CertCompressionAlgo { return CertCompressionZstd }
+
+func (zstdCertCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(src, dst), nil
+}
+
+func (zstdCertCompressor) Decompress(dst, src []byte, maxSize int64) ([]byte, error) {
+	dec := zstdDecoderPool.Get().(*zstd.Decoder)
+	defer func() {
+		dec.Reset(nil)
+		zstdDecoderPool.Put(dec)
+	}()
+
+	if err := dec.Reset(bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+	decompressed, err := readAllCapped(dec, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, decompressed...), nil
+}